@@ -23,10 +23,39 @@ import (
 )
 
 type Enforcer struct {
-	labelMatchers  map[string]*labels.Matcher
-	errorOnReplace bool
+	labelMatchers    map[string]*labels.Matcher
+	errorOnReplace   bool
+	labelReplaceMode LabelReplaceMode
+
+	// expr holds the boolean enforcement rule built from an
+	// EnforcementExpr tree, as constructed by NewEnforcerFromExpr. It is
+	// nil for Enforcers built with NewEnforcer, which keep relying on
+	// labelMatchers/errorOnReplace.
+	expr *EnforcementExpr
 }
 
+// LabelReplaceMode controls how EnforceNode reacts when it finds a
+// label_replace() or label_join() call whose destination label collides
+// with one of the enforced labels.
+type LabelReplaceMode int
+
+const (
+	// RejectLabelReplace makes EnforceNode return an
+	// IllegalLabelReplaceError. This is the zero value, so an Enforcer
+	// is safe by default.
+	RejectLabelReplace LabelReplaceMode = iota
+	// RewriteLabelReplace makes EnforceNode silently rewrite the
+	// destination label of the offending call to a harmless,
+	// non-enforced label instead of rejecting the query outright.
+	RewriteLabelReplace
+)
+
+// quarantinedLabelReplaceTarget is the label name substituted for the
+// destination of a label_replace()/label_join() call that would
+// otherwise overwrite an enforced label, when operating in
+// RewriteLabelReplace mode.
+const quarantinedLabelReplaceTarget = "_label_replace_blocked_"
+
 func equalMatcher(label string, vals ...string) *labels.Matcher {
 	if len(vals) == 1 {
 		return &labels.Matcher{
@@ -73,6 +102,22 @@ func NewEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *Enforcer {
 	}
 }
 
+// NewEnforcerFromExpr builds an Enforcer from a boolean EnforcementExpr
+// tree, allowing enforcement rules that a flat, AND'd list of matchers
+// cannot express, such as "tenant in {a,b,c} AND (env=prod OR
+// env=stage)". See ParseEnforcementExpr for the accepted syntax.
+func NewEnforcerFromExpr(expr *EnforcementExpr) *Enforcer {
+	return &Enforcer{expr: expr}
+}
+
+// SetLabelReplaceMode configures how EnforceNode reacts to label_replace()
+// and label_join() calls that target an enforced label. The default
+// (zero value) mode is RejectLabelReplace.
+func (ms *Enforcer) SetLabelReplaceMode(mode LabelReplaceMode) *Enforcer {
+	ms.labelReplaceMode = mode
+	return ms
+}
+
 type IllegalLabelMatcherError struct {
 	msg string
 }
@@ -85,87 +130,177 @@ func newIllegalLabelMatcherError(existing string, replacement string) IllegalLab
 	}
 }
 
-// EnforceNode walks the given node recursively
-// and enforces the given label enforcer on it.
+// EnforceNode walks the given node recursively and enforces the enforcer's
+// rule on it.
 //
-// Whenever a parser.MatrixSelector or parser.VectorSelector AST node is found,
-// their label enforcer is being potentially modified.
-// If a node's label matcher has the same name as a label matcher
-// of the given enforcer, then it will be replaced.
-func (ms Enforcer) EnforceNode(node parser.Node) error {
+// Whenever a parser.MatrixSelector or parser.VectorSelector AST node is
+// found, their label matchers are potentially modified. If a node's label
+// matcher has the same name as a label matcher of the given enforcer, then
+// it will be replaced.
+//
+// When the Enforcer was built from an EnforcementExpr containing an "or",
+// a parser.VectorSelector cannot always be enforced in place: disjunction
+// of matchers on the same label with different values has no single-
+// selector representation, so the vector selector is replaced by a
+// parser.BinaryExpr OR-ing one copy of the selector per disjunct. Callers
+// that hold a reference to the original expression should therefore always
+// use the (possibly different) parser.Node returned by EnforceNode, not the
+// node they passed in.
+func (ms Enforcer) EnforceNode(node parser.Node) (parser.Node, error) {
 	switch n := node.(type) {
 	case *parser.EvalStmt:
-		if err := ms.EnforceNode(n.Expr); err != nil {
-			return err
+		expr, err := ms.enforceExpr(n.Expr)
+		if err != nil {
+			return nil, err
 		}
+		n.Expr = expr
+		return n, nil
 
 	case parser.Expressions:
-		for _, e := range n {
-			if err := ms.EnforceNode(e); err != nil {
-				return err
+		for i, e := range n {
+			expr, err := ms.enforceExpr(e)
+			if err != nil {
+				return nil, err
 			}
+			n[i] = expr
 		}
+		return n, nil
 
 	case *parser.AggregateExpr:
-		if err := ms.EnforceNode(n.Expr); err != nil {
-			return err
+		expr, err := ms.enforceExpr(n.Expr)
+		if err != nil {
+			return nil, err
 		}
+		n.Expr = expr
+		return n, nil
 
 	case *parser.BinaryExpr:
-		if err := ms.EnforceNode(n.LHS); err != nil {
-			return err
+		lhs, err := ms.enforceExpr(n.LHS)
+		if err != nil {
+			return nil, err
 		}
+		n.LHS = lhs
 
-		if err := ms.EnforceNode(n.RHS); err != nil {
-			return err
+		rhs, err := ms.enforceExpr(n.RHS)
+		if err != nil {
+			return nil, err
 		}
+		n.RHS = rhs
+
+		return n, nil
 
 	case *parser.Call:
-		if err := ms.EnforceNode(n.Args); err != nil {
-			return err
+		if err := ms.checkLabelReplaceCall(n); err != nil {
+			return nil, err
 		}
 
+		args, err := ms.EnforceNode(n.Args)
+		if err != nil {
+			return nil, err
+		}
+		n.Args = args.(parser.Expressions)
+		return n, nil
+
 	case *parser.SubqueryExpr:
-		if err := ms.EnforceNode(n.Expr); err != nil {
-			return err
+		expr, err := ms.enforceExpr(n.Expr)
+		if err != nil {
+			return nil, err
 		}
+		n.Expr = expr
+		return n, nil
 
 	case *parser.ParenExpr:
-		if err := ms.EnforceNode(n.Expr); err != nil {
-			return err
+		expr, err := ms.enforceExpr(n.Expr)
+		if err != nil {
+			return nil, err
 		}
+		n.Expr = expr
+		return n, nil
 
 	case *parser.UnaryExpr:
-		if err := ms.EnforceNode(n.Expr); err != nil {
-			return err
+		expr, err := ms.enforceExpr(n.Expr)
+		if err != nil {
+			return nil, err
 		}
+		n.Expr = expr
+		return n, nil
 
 	case *parser.NumberLiteral, *parser.StringLiteral:
-	// nothing to do
+		return n, nil
 
 	case *parser.MatrixSelector:
-		// inject labelselector
+		// Unlike a parser.VectorSelector, a range vector cannot be
+		// replaced by an OR'd BinaryExpr: parser.MatrixSelector.VectorSelector
+		// must stay a plain vector selector, so an EnforcementExpr whose
+		// disjunctive normal form has more than one disjunct (an "or" that
+		// can't collapse to a single matcher set) cannot be enforced here
+		// and is rejected instead of silently under-enforcing it.
 		if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
-			var err error
-			vs.LabelMatchers, err = ms.EnforceMatchers(vs.LabelMatchers)
+			branches, err := ms.enforceMatcherBranches(vs.LabelMatchers)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if len(branches) > 1 {
+				return nil, fmt.Errorf("cannot enforce an \"or\" enforcement rule on a range vector selector %s", vs)
 			}
+			vs.LabelMatchers = branches[0]
 		}
+		return n, nil
 
 	case *parser.VectorSelector:
-		// inject labelselector
-		var err error
-		n.LabelMatchers, err = ms.EnforceMatchers(n.LabelMatchers)
-		if err != nil {
-			return err
-		}
+		return ms.enforceVectorSelector(n)
 
 	default:
 		panic(fmt.Errorf("parser.Walk: unhandled node type %T", n))
 	}
+}
+
+// enforceExpr is a typed convenience wrapper around EnforceNode for the
+// common case of enforcing a single parser.Expr field.
+func (ms Enforcer) enforceExpr(e parser.Expr) (parser.Expr, error) {
+	n, err := ms.EnforceNode(e)
+	if err != nil {
+		return nil, err
+	}
+	return n.(parser.Expr), nil
+}
+
+// enforceVectorSelector enforces ms on a single vector selector. With a
+// flat, AND'd set of matchers (NewEnforcer) it mutates n in place. With a
+// boolean EnforcementExpr (NewEnforcerFromExpr) it expands n's label
+// matchers into disjunctive normal form and, if that form has more than one
+// disjunct, returns a parser.BinaryExpr OR-ing one enforced copy of n per
+// disjunct instead.
+func (ms Enforcer) enforceVectorSelector(n *parser.VectorSelector) (parser.Expr, error) {
+	branches, err := ms.enforceMatcherBranches(n.LabelMatchers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(branches) == 1 {
+		n.LabelMatchers = branches[0]
+		return n, nil
+	}
+
+	var result parser.Expr
+	for _, branch := range branches {
+		clone := *n
+		clone.LabelMatchers = branch
+
+		if result == nil {
+			result = &clone
+			continue
+		}
+
+		result = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            result,
+			RHS:            &clone,
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
 
-	return nil
+	return result, nil
 }
 
 // EnforceMatchers appends the configured label matcher if not present.
@@ -201,3 +336,80 @@ func (ms Enforcer) EnforceMatchers(targets []*labels.Matcher) ([]*labels.Matcher
 
 	return res, nil
 }
+
+type IllegalLabelReplaceError struct {
+	msg string
+}
+
+func (e IllegalLabelReplaceError) Error() string { return e.msg }
+
+func newIllegalLabelReplaceError(funcName, label string) IllegalLabelReplaceError {
+	return IllegalLabelReplaceError{
+		msg: fmt.Sprintf("%s() is not allowed to target the enforced label %q", funcName, label),
+	}
+}
+
+// checkLabelReplaceCall inspects n for a label_replace() or label_join()
+// call whose destination label (dst_label) collides with one of the
+// enforced labels. label_replace() and label_join() rewrite series labels
+// after any selector has already been evaluated, so without this check a
+// query could smuggle out series under a forged value for an enforced
+// label, e.g.:
+//
+//	label_replace(up{namespace="a"}, "namespace", "b", "", "")
+//
+// Because EnforceNode recurses into every parser.Call regardless of where
+// it is nested (including inside aggregations), a label_replace()/
+// label_join() call used to reintroduce a label dropped by an outer
+// "by"/"without" clause is caught the same way.
+func (ms Enforcer) checkLabelReplaceCall(n *parser.Call) error {
+	if n.Func == nil {
+		return nil
+	}
+
+	var dstArg int
+	switch n.Func.Name {
+	case "label_replace", "label_join":
+		dstArg = 1
+	default:
+		return nil
+	}
+
+	if len(n.Args) <= dstArg {
+		return nil
+	}
+
+	dst, ok := n.Args[dstArg].(*parser.StringLiteral)
+	if !ok {
+		return nil
+	}
+
+	if !ms.isEnforcedLabel(dst.Val) {
+		return nil
+	}
+
+	switch ms.labelReplaceMode {
+	case RewriteLabelReplace:
+		dst.Val = quarantinedLabelReplaceTarget
+		return nil
+	default:
+		return newIllegalLabelReplaceError(n.Func.Name, dst.Val)
+	}
+}
+
+// isEnforcedLabel reports whether name is one of the labels ms enforces,
+// whether ms was built from a flat matcher list (NewEnforcer) or a boolean
+// EnforcementExpr (NewEnforcerFromExpr).
+func (ms Enforcer) isEnforcedLabel(name string) bool {
+	if _, ok := ms.labelMatchers[name]; ok {
+		return true
+	}
+
+	if ms.expr != nil {
+		if _, ok := ms.expr.labelNames()[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// TestEnforceNodeRejectsLabelReplaceSmuggling guards against the
+// label_replace()/label_join() smuggling vector both for Enforcers built
+// from a flat matcher list and for ones built from an EnforcementExpr:
+// regardless of constructor, a query must not be able to rewrite an
+// enforced label back to an attacker-chosen value after the selector has
+// already been filtered.
+func TestEnforceNodeRejectsLabelReplaceSmuggling(t *testing.T) {
+	const query = `label_replace(up{namespace="a"}, "namespace", "b", "", "")`
+
+	enforcers := map[string]*Enforcer{
+		"NewEnforcer": NewEnforcer(false, &labels.Matcher{
+			Type:  labels.MatchEqual,
+			Name:  "namespace",
+			Value: "a",
+		}),
+		"NewEnforcerFromExpr": NewEnforcerFromExpr(
+			MatchExpr("namespace", labels.MatchEqual, "a", false),
+		),
+	}
+
+	for name, enforcer := range enforcers {
+		t.Run(name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(query)
+			if err != nil {
+				t.Fatalf("failed to parse query: %v", err)
+			}
+
+			_, err = enforcer.EnforceNode(expr)
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+
+			var target IllegalLabelReplaceError
+			if !errors.As(err, &target) {
+				t.Fatalf("expected an IllegalLabelReplaceError, got %T: %v", err, err)
+			}
+		})
+	}
+}
+
+// TestEnforceNodeRewritesLabelReplaceSmuggling covers RewriteLabelReplace
+// mode for both constructors.
+func TestEnforceNodeRewritesLabelReplaceSmuggling(t *testing.T) {
+	const query = `label_join(up{namespace="a"}, "namespace", ",", "pod")`
+
+	enforcers := map[string]*Enforcer{
+		"NewEnforcer": NewEnforcer(false, &labels.Matcher{
+			Type:  labels.MatchEqual,
+			Name:  "namespace",
+			Value: "a",
+		}).SetLabelReplaceMode(RewriteLabelReplace),
+		"NewEnforcerFromExpr": NewEnforcerFromExpr(
+			MatchExpr("namespace", labels.MatchEqual, "a", false),
+		).SetLabelReplaceMode(RewriteLabelReplace),
+	}
+
+	for name, enforcer := range enforcers {
+		t.Run(name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(query)
+			if err != nil {
+				t.Fatalf("failed to parse query: %v", err)
+			}
+
+			enforced, err := enforcer.EnforceNode(expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			call, ok := enforced.(*parser.Call)
+			if !ok {
+				t.Fatalf("expected *parser.Call, got %T", enforced)
+			}
+
+			dst, ok := call.Args[1].(*parser.StringLiteral)
+			if !ok {
+				t.Fatalf("expected *parser.StringLiteral, got %T", call.Args[1])
+			}
+
+			if dst.Val == "namespace" {
+				t.Fatal("destination label was not rewritten")
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// exprKind identifies the kind of an EnforcementExpr node.
+type exprKind int
+
+const (
+	exprKindMatch exprKind = iota
+	exprKindAnd
+	exprKindOr
+	exprKindNot
+)
+
+// EnforcementExpr is a boolean tree of label matchers, used to express
+// enforcement rules that a flat, AND'd list of matchers cannot, such as
+// "tenant in {a,b,c} AND (env=prod OR env=stage)".
+type EnforcementExpr struct {
+	kind exprKind
+
+	// Populated when kind == exprKindMatch.
+	name           string
+	matchType      labels.MatchType
+	value          string
+	errorOnReplace bool
+
+	// Populated when kind is exprKindAnd, exprKindOr (any length) or
+	// exprKindNot (always exactly one child).
+	children []*EnforcementExpr
+}
+
+// MatchExpr builds a leaf EnforcementExpr matching a single label. It
+// mirrors the errorOnReplace semantics of NewEnforcer, but scoped to this
+// one matcher instead of the whole Enforcer.
+func MatchExpr(name string, matchType labels.MatchType, value string, errorOnReplace bool) *EnforcementExpr {
+	return &EnforcementExpr{
+		kind:           exprKindMatch,
+		name:           name,
+		matchType:      matchType,
+		value:          value,
+		errorOnReplace: errorOnReplace,
+	}
+}
+
+// AndExpr builds an EnforcementExpr requiring all of children to hold.
+func AndExpr(children ...*EnforcementExpr) *EnforcementExpr {
+	return &EnforcementExpr{kind: exprKindAnd, children: children}
+}
+
+// OrExpr builds an EnforcementExpr requiring at least one of children to
+// hold.
+func OrExpr(children ...*EnforcementExpr) *EnforcementExpr {
+	return &EnforcementExpr{kind: exprKindOr, children: children}
+}
+
+// NotExpr builds an EnforcementExpr negating child.
+func NotExpr(child *EnforcementExpr) *EnforcementExpr {
+	return &EnforcementExpr{kind: exprKindNot, children: []*EnforcementExpr{child}}
+}
+
+// labelNames returns the set of label names appearing anywhere in e,
+// regardless of "and"/"or"/"not" nesting. It is used to recognize enforced
+// labels (e.g. to guard against label_replace()/label_join() smuggling)
+// without going through toDNF, since the set of enforced label names does
+// not depend on how the expression's disjuncts are combined.
+func (e *EnforcementExpr) labelNames() map[string]struct{} {
+	set := make(map[string]struct{})
+	e.collectLabelNames(set)
+	return set
+}
+
+func (e *EnforcementExpr) collectLabelNames(set map[string]struct{}) {
+	switch e.kind {
+	case exprKindMatch:
+		set[e.name] = struct{}{}
+
+	case exprKindNot:
+		e.children[0].collectLabelNames(set)
+
+	case exprKindAnd, exprKindOr:
+		for _, c := range e.children {
+			c.collectLabelNames(set)
+		}
+	}
+}
+
+// matcherApplication is a single matcher together with the errorOnReplace
+// semantics of the leaf it came from.
+type matcherApplication struct {
+	matcher        *labels.Matcher
+	errorOnReplace bool
+}
+
+// toDNF converts e into disjunctive normal form: a list of conjunctions,
+// each a list of matcherApplications that must all hold. "or" at any depth
+// becomes additional top-level conjunctions; "not" is pushed down to the
+// leaves via De Morgan's laws so that every conjunction only ever contains
+// positive or negated matchers, never a negated subtree.
+func (e *EnforcementExpr) toDNF() ([][]matcherApplication, error) {
+	return e.toDNFNegated(false)
+}
+
+func (e *EnforcementExpr) toDNFNegated(negate bool) ([][]matcherApplication, error) {
+	switch e.kind {
+	case exprKindMatch:
+		matchType := e.matchType
+		if negate {
+			negated, err := negateMatchType(matchType)
+			if err != nil {
+				return nil, err
+			}
+			matchType = negated
+		}
+
+		m, err := labels.NewMatcher(matchType, e.name, e.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid matcher %s: %w", e, err)
+		}
+
+		return [][]matcherApplication{{{matcher: m, errorOnReplace: e.errorOnReplace}}}, nil
+
+	case exprKindNot:
+		return e.children[0].toDNFNegated(!negate)
+
+	case exprKindAnd, exprKindOr:
+		// De Morgan's laws: negating an And turns it into an Or of
+		// negated children, and vice-versa.
+		isOr := e.kind == exprKindOr
+		if negate {
+			isOr = !isOr
+		}
+
+		childBranches := make([][][]matcherApplication, len(e.children))
+		for i, c := range e.children {
+			branches, err := c.toDNFNegated(negate)
+			if err != nil {
+				return nil, err
+			}
+			childBranches[i] = branches
+		}
+
+		if isOr {
+			var res [][]matcherApplication
+			for _, branches := range childBranches {
+				res = append(res, branches...)
+			}
+			return res, nil
+		}
+
+		// Conjunction: the cartesian product of the children's branches.
+		res := [][]matcherApplication{{}}
+		for _, branches := range childBranches {
+			var next [][]matcherApplication
+			for _, base := range res {
+				for _, branch := range branches {
+					combined := make([]matcherApplication, 0, len(base)+len(branch))
+					combined = append(combined, base...)
+					combined = append(combined, branch...)
+					next = append(next, combined)
+				}
+			}
+			res = next
+		}
+		return res, nil
+
+	default:
+		panic(fmt.Errorf("EnforcementExpr: unhandled kind %d", e.kind))
+	}
+}
+
+func negateMatchType(t labels.MatchType) (labels.MatchType, error) {
+	switch t {
+	case labels.MatchEqual:
+		return labels.MatchNotEqual, nil
+	case labels.MatchNotEqual:
+		return labels.MatchEqual, nil
+	case labels.MatchRegexp:
+		return labels.MatchNotRegexp, nil
+	case labels.MatchNotRegexp:
+		return labels.MatchRegexp, nil
+	default:
+		return t, fmt.Errorf("unknown match type %v", t)
+	}
+}
+
+// String renders e back to the syntax accepted by ParseEnforcementExpr.
+func (e *EnforcementExpr) String() string {
+	switch e.kind {
+	case exprKindMatch:
+		return fmt.Sprintf("{%s%s%s}", e.name, matchTypeOp(e.matchType), strconv.Quote(e.value))
+
+	case exprKindNot:
+		return "not " + e.children[0].String()
+
+	case exprKindAnd:
+		return joinChildren(e.children, "and")
+
+	case exprKindOr:
+		return joinChildren(e.children, "or")
+
+	default:
+		panic(fmt.Errorf("EnforcementExpr: unhandled kind %d", e.kind))
+	}
+}
+
+func joinChildren(children []*EnforcementExpr, op string) string {
+	parts := make([]string, len(children))
+	for i, c := range children {
+		parts[i] = "(" + c.String() + ")"
+	}
+	return strings.Join(parts, " "+op+" ")
+}
+
+func matchTypeOp(t labels.MatchType) string {
+	switch t {
+	case labels.MatchEqual:
+		return "="
+	case labels.MatchNotEqual:
+		return "!="
+	case labels.MatchRegexp:
+		return "=~"
+	case labels.MatchNotRegexp:
+		return "!~"
+	default:
+		panic(fmt.Errorf("labels: unhandled match type %v", t))
+	}
+}
+
+// mergeMatchers applies branch on top of targets, following the same
+// precedence rules as Enforcer.EnforceMatchers: an existing matcher that
+// differs from an enforced matcher for the same label is rejected if that
+// enforced matcher's leaf has errorOnReplace set; otherwise an enforced
+// equality matcher replaces the existing matcher, and any other collision
+// keeps both.
+func mergeMatchers(targets []*labels.Matcher, branch []matcherApplication) ([]*labels.Matcher, error) {
+	// A branch can carry more than one matcherApplication for the same
+	// label name, e.g. "{tenant=~\"a|b\"} and not {tenant=\"c\"}" produces
+	// both a MatchRegexp and a MatchNotEqual application for "tenant".
+	// Keying by name must therefore collect all of them, not just the
+	// last one seen.
+	enforced := make(map[string][]matcherApplication, len(branch))
+	for _, a := range branch {
+		enforced[a.matcher.Name] = append(enforced[a.matcher.Name], a)
+	}
+
+	var res []*labels.Matcher
+	for _, target := range targets {
+		as, ok := enforced[target.Name]
+		replaced := false
+		for _, a := range as {
+			if a.errorOnReplace && a.matcher.String() != target.String() {
+				return nil, newIllegalLabelMatcherError(a.matcher.String(), target.String())
+			}
+			if a.matcher.Type == labels.MatchEqual {
+				replaced = true
+			}
+		}
+
+		if ok && replaced {
+			continue
+		}
+		res = append(res, target)
+	}
+
+	for _, as := range enforced {
+		for _, a := range as {
+			res = append(res, a.matcher)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ParseEnforcementExpr parses a boolean enforcement rule of the form:
+//
+//	{tenant=~"a|b"} and ({env="prod"} or {env="stage"})
+//
+// Leaves are single-matcher braces using the same operators as PromQL
+// selectors (=, !=, =~, !~); "and", "or" and "not" combine them, with "not"
+// binding tighter than "and", which binds tighter than "or". Parentheses
+// group sub-expressions. Every leaf is built with errorOnReplace set to
+// errorOnReplace; use MatchExpr directly for per-leaf control.
+func ParseEnforcementExpr(s string, errorOnReplace bool) (*EnforcementExpr, error) {
+	toks, err := lexEnforcementExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{toks: toks, errorOnReplace: errorOnReplace}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected token %q", p.peek().val)
+	}
+
+	return expr, nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokLBrace
+	tokRBrace
+	tokLParen
+	tokRParen
+	tokIdent
+	tokOp
+	tokString
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind tokKind
+	val  string
+}
+
+func lexEnforcementExpr(s string) ([]token, error) {
+	var toks []token
+
+	runes := []rune(s)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '{':
+			toks = append(toks, token{kind: tokLBrace})
+			i++
+
+		case r == '}':
+			toks = append(toks, token{kind: tokRBrace})
+			i++
+
+		case r == '(':
+			toks = append(toks, token{kind: tokLParen})
+			i++
+
+		case r == ')':
+			toks = append(toks, token{kind: tokRParen})
+			i++
+
+		case r == '=' || r == '!':
+			start := i
+			i++
+			if i < len(runes) && (runes[i] == '~' || runes[i] == '=') {
+				i++
+			}
+			op := string(runes[start:i])
+			switch op {
+			case "=", "!=", "=~", "!~":
+				toks = append(toks, token{kind: tokOp, val: op})
+			default:
+				return nil, fmt.Errorf("invalid operator %q", op)
+			}
+
+		case r == '"':
+			start := i
+			i++
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					i++
+					break
+				}
+				i++
+			}
+			if i > len(runes) || runes[i-1] != '"' {
+				return nil, fmt.Errorf("unterminated string literal starting at %q", string(runes[start:]))
+			}
+			val, err := strconv.Unquote(string(runes[start:i]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid string literal: %w", err)
+			}
+			toks = append(toks, token{kind: tokString, val: val})
+
+		case isIdentRune(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			switch strings.ToLower(word) {
+			case "and":
+				toks = append(toks, token{kind: tokAnd})
+			case "or":
+				toks = append(toks, token{kind: tokOr})
+			case "not":
+				toks = append(toks, token{kind: tokNot})
+			default:
+				toks = append(toks, token{kind: tokIdent, val: word})
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+
+	toks = append(toks, token{kind: tokEOF})
+	return toks, nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+type exprParser struct {
+	toks           []token
+	pos            int
+	errorOnReplace bool
+}
+
+func (p *exprParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.toks[p.pos]
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return t
+}
+
+// parseOr := parseAnd ("or" parseAnd)*
+func (p *exprParser) parseOr() (*EnforcementExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*EnforcementExpr{left}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return OrExpr(children...), nil
+}
+
+// parseAnd := parseUnary ("and" parseUnary)*
+func (p *exprParser) parseAnd() (*EnforcementExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*EnforcementExpr{left}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return AndExpr(children...), nil
+}
+
+// parseUnary := "not" parseUnary | parsePrimary
+func (p *exprParser) parseUnary() (*EnforcementExpr, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotExpr(child), nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary := "(" parseOr ")" | leaf
+func (p *exprParser) parsePrimary() (*EnforcementExpr, error) {
+	switch p.peek().kind {
+	case tokLParen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, fmt.Errorf("expected closing parenthesis, got %q", p.peek().val)
+		}
+		p.next()
+		return expr, nil
+
+	case tokLBrace:
+		return p.parseLeaf()
+
+	default:
+		return nil, fmt.Errorf("expected '(' or '{', got %q", p.peek().val)
+	}
+}
+
+// parseLeaf := "{" IDENT OP STRING "}"
+func (p *exprParser) parseLeaf() (*EnforcementExpr, error) {
+	p.next() // consume '{'
+
+	name := p.next()
+	if name.kind != tokIdent {
+		return nil, fmt.Errorf("expected label name, got %q", name.val)
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected a matcher operator, got %q", op.val)
+	}
+
+	val := p.next()
+	if val.kind != tokString {
+		return nil, fmt.Errorf("expected a quoted value, got %q", val.val)
+	}
+
+	if p.peek().kind != tokRBrace {
+		return nil, fmt.Errorf("expected closing brace, got %q", p.peek().val)
+	}
+	p.next()
+
+	matchType, err := matchTypeFromOp(op.val)
+	if err != nil {
+		return nil, err
+	}
+
+	return MatchExpr(name.val, matchType, val.val, p.errorOnReplace), nil
+}
+
+func matchTypeFromOp(op string) (labels.MatchType, error) {
+	switch op {
+	case "=":
+		return labels.MatchEqual, nil
+	case "!=":
+		return labels.MatchNotEqual, nil
+	case "=~":
+		return labels.MatchRegexp, nil
+	case "!~":
+		return labels.MatchNotRegexp, nil
+	default:
+		return 0, fmt.Errorf("unknown matcher operator %q", op)
+	}
+}
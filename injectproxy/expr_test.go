@@ -0,0 +1,413 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestParseEnforcementExprGrammar(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "single leaf",
+			input: `{tenant="a"}`,
+			want:  `{tenant="a"}`,
+		},
+		{
+			name:  "and binds tighter than or",
+			input: `{a="1"} or {b="2"} and {c="3"}`,
+			want:  `({a="1"}) or (({b="2"}) and ({c="3"}))`,
+		},
+		{
+			name:  "not binds tighter than and",
+			input: `not {a="1"} and {b="2"}`,
+			want:  `(not {a="1"}) and ({b="2"})`,
+		},
+		{
+			name:  "parens override precedence",
+			input: `({a="1"} or {b="2"}) and {c="3"}`,
+			want:  `(({a="1"}) or ({b="2"})) and ({c="3"})`,
+		},
+		{
+			name:  "all four operators",
+			input: `{a="1"} and {b!="2"} and {c=~"3"} and {d!~"4"}`,
+			want:  `({a="1"}) and ({b!="2"}) and ({c=~"3"}) and ({d!~"4"})`,
+		},
+		{
+			name:    "missing operator",
+			input:   `{tenant "a"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unbalanced paren",
+			input:   `({a="1"} or {b="2"}`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing garbage",
+			input:   `{a="1"} extra`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseEnforcementExpr(tc.input, false)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.String() != tc.want {
+				t.Fatalf("got %q, want %q", got.String(), tc.want)
+			}
+		})
+	}
+}
+
+// dnfStrings renders toDNF's output as a sorted, comparable set of
+// branches, each branch a sorted set of matcher strings, so test cases
+// don't need to care about the order toDNF happens to produce.
+func dnfStrings(t *testing.T, e *EnforcementExpr) []string {
+	t.Helper()
+
+	branches, err := e.toDNF()
+	if err != nil {
+		t.Fatalf("toDNF failed: %v", err)
+	}
+
+	var out []string
+	for _, branch := range branches {
+		parts := make([]string, len(branch))
+		for i, a := range branch {
+			parts[i] = a.matcher.String()
+		}
+		sort.Strings(parts)
+		out = append(out, "["+stringsJoin(parts)+"]")
+	}
+	sort.Strings(out)
+	return out
+}
+
+func stringsJoin(parts []string) string {
+	out := ""
+	for i, p := range parts {
+		if i > 0 {
+			out += ","
+		}
+		out += p
+	}
+	return out
+}
+
+func TestEnforcementExprToDNF(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		expr *EnforcementExpr
+		want []string
+	}{
+		{
+			name: "single match",
+			expr: MatchExpr("tenant", labels.MatchEqual, "a", false),
+			want: []string{`[tenant="a"]`},
+		},
+		{
+			name: "and of two matches",
+			expr: AndExpr(
+				MatchExpr("tenant", labels.MatchEqual, "a", false),
+				MatchExpr("env", labels.MatchEqual, "prod", false),
+			),
+			want: []string{`[env="prod",tenant="a"]`},
+		},
+		{
+			name: "or produces one branch per disjunct",
+			expr: OrExpr(
+				MatchExpr("env", labels.MatchEqual, "prod", false),
+				MatchExpr("env", labels.MatchEqual, "stage", false),
+			),
+			want: []string{`[env="prod"]`, `[env="stage"]`},
+		},
+		{
+			name: "and distributes over or (cartesian product)",
+			expr: AndExpr(
+				MatchExpr("tenant", labels.MatchEqual, "a", false),
+				OrExpr(
+					MatchExpr("env", labels.MatchEqual, "prod", false),
+					MatchExpr("env", labels.MatchEqual, "stage", false),
+				),
+			),
+			want: []string{`[env="prod",tenant="a"]`, `[env="stage",tenant="a"]`},
+		},
+		{
+			name: "not pushes down via De Morgan onto a match leaf",
+			expr: NotExpr(MatchExpr("tenant", labels.MatchEqual, "a", false)),
+			want: []string{`[tenant!="a"]`},
+		},
+		{
+			name: "not of an and becomes an or (De Morgan)",
+			expr: NotExpr(AndExpr(
+				MatchExpr("a", labels.MatchEqual, "1", false),
+				MatchExpr("b", labels.MatchEqual, "2", false),
+			)),
+			want: []string{`[a!="1"]`, `[b!="2"]`},
+		},
+		{
+			name: "not of an or becomes an and (De Morgan)",
+			expr: NotExpr(OrExpr(
+				MatchExpr("a", labels.MatchEqual, "1", false),
+				MatchExpr("b", labels.MatchEqual, "2", false),
+			)),
+			want: []string{`[a!="1",b!="2"]`},
+		},
+		{
+			name: "allow a or b except c",
+			expr: AndExpr(
+				MatchExpr("tenant", labels.MatchRegexp, "a|b", false),
+				NotExpr(MatchExpr("tenant", labels.MatchEqual, "c", false)),
+			),
+			want: []string{`[tenant!="c",tenant=~"a|b"]`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := dnfStrings(t, tc.expr)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got branches %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got branches %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// TestMergeMatchersKeepsAllMatchersForSameLabel is a regression test: a
+// single AND branch carrying two matcherApplications for the same label
+// (e.g. from "{tenant=~\"a|b\"} and not {tenant=\"c\"}") must have both
+// applied, not just one silently dropped by a name-keyed map.
+func TestMergeMatchersKeepsAllMatchersForSameLabel(t *testing.T) {
+	expr := AndExpr(
+		MatchExpr("tenant", labels.MatchRegexp, "a|b", false),
+		NotExpr(MatchExpr("tenant", labels.MatchEqual, "c", false)),
+	)
+
+	branches, err := expr.toDNF()
+	if err != nil {
+		t.Fatalf("toDNF failed: %v", err)
+	}
+	if len(branches) != 1 {
+		t.Fatalf("expected a single branch, got %d", len(branches))
+	}
+
+	merged, err := mergeMatchers(nil, branches[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byName := map[string][]*labels.Matcher{}
+	for _, m := range merged {
+		byName[m.Name] = append(byName[m.Name], m)
+	}
+
+	if len(byName["tenant"]) != 2 {
+		t.Fatalf("expected both tenant matchers to survive, got %v", merged)
+	}
+
+	var sawRegexp, sawNotEqual bool
+	for _, m := range byName["tenant"] {
+		switch {
+		case m.Type == labels.MatchRegexp && m.Value == "a|b":
+			sawRegexp = true
+		case m.Type == labels.MatchNotEqual && m.Value == "c":
+			sawNotEqual = true
+		}
+	}
+	if !sawRegexp || !sawNotEqual {
+		t.Fatalf("expected both the tenant=~\"a|b\" and tenant!=\"c\" matchers, got %v", merged)
+	}
+}
+
+// TestMergeMatchersErrorOnReplaceChecksEveryMatcherForTheLabel verifies
+// that errorOnReplace is honored for every matcherApplication sharing a
+// label name, not just the last one a name-keyed map happened to retain.
+func TestMergeMatchersErrorOnReplaceChecksEveryMatcherForTheLabel(t *testing.T) {
+	expr := AndExpr(
+		MatchExpr("tenant", labels.MatchRegexp, "a|b", false),
+		NotExpr(MatchExpr("tenant", labels.MatchEqual, "c", true)),
+	)
+
+	branches, err := expr.toDNF()
+	if err != nil {
+		t.Fatalf("toDNF failed: %v", err)
+	}
+
+	target := &labels.Matcher{Type: labels.MatchEqual, Name: "tenant", Value: "z"}
+	if _, err := mergeMatchers([]*labels.Matcher{target}, branches[0]); err == nil {
+		t.Fatal("expected an IllegalLabelMatcherError for the conflicting tenant!=\"c\" matcher")
+	}
+}
+
+func TestEnforceNodeExpandsOrIntoBinaryExpr(t *testing.T) {
+	enforcer := NewEnforcerFromExpr(OrExpr(
+		MatchExpr("env", labels.MatchEqual, "prod", false),
+		MatchExpr("env", labels.MatchEqual, "stage", false),
+	))
+
+	expr, err := parser.ParseExpr(`up{namespace="a"}`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	enforced, err := enforcer.EnforceNode(expr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bin, ok := enforced.(*parser.BinaryExpr)
+	if !ok {
+		t.Fatalf("expected a *parser.BinaryExpr, got %T", enforced)
+	}
+	if bin.Op != parser.LOR {
+		t.Fatalf("expected an OR, got op %v", bin.Op)
+	}
+
+	lhs, ok := bin.LHS.(*parser.VectorSelector)
+	if !ok {
+		t.Fatalf("expected LHS to be a *parser.VectorSelector, got %T", bin.LHS)
+	}
+	rhs, ok := bin.RHS.(*parser.VectorSelector)
+	if !ok {
+		t.Fatalf("expected RHS to be a *parser.VectorSelector, got %T", bin.RHS)
+	}
+
+	var envValues []string
+	for _, vs := range []*parser.VectorSelector{lhs, rhs} {
+		for _, m := range vs.LabelMatchers {
+			if m.Name == "env" {
+				envValues = append(envValues, m.Value)
+			}
+		}
+	}
+	sort.Strings(envValues)
+	if len(envValues) != 2 || envValues[0] != "prod" || envValues[1] != "stage" {
+		t.Fatalf("expected env matchers {prod,stage}, got %v", envValues)
+	}
+}
+
+// TestEnforceNodeRejectsOrOnMatrixSelector is a regression test: a range
+// vector selector (e.g. the argument to rate()) has no way to represent
+// an "or" enforcement rule that doesn't collapse to a single matcher set,
+// since parser.MatrixSelector.VectorSelector must stay a plain vector
+// selector. EnforceNode must reject the query rather than silently
+// enforcing only one branch (or none at all).
+func TestEnforceNodeRejectsOrOnMatrixSelector(t *testing.T) {
+	enforcer := NewEnforcerFromExpr(OrExpr(
+		MatchExpr("env", labels.MatchEqual, "prod", false),
+		MatchExpr("env", labels.MatchEqual, "stage", false),
+	))
+
+	expr, err := parser.ParseExpr(`rate(up[5m])`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	if _, err := enforcer.EnforceNode(expr); err == nil {
+		t.Fatal("expected an error enforcing an \"or\" rule on a range vector selector")
+	}
+}
+
+// TestEnforceNodeEnforcesMatrixSelectorUnderExprEnforcer is a regression
+// test for the legacy-path bug where a *parser.MatrixSelector's matchers
+// were enforced via the flat ms.labelMatchers map (always empty for an
+// Enforcer built with NewEnforcerFromExpr), silently skipping enforcement
+// for every range-vector query (rate(), increase(), ...) under a
+// boolean-expression enforcer.
+func TestEnforceNodeEnforcesMatrixSelectorUnderExprEnforcer(t *testing.T) {
+	enforcer := NewEnforcerFromExpr(MatchExpr("namespace", labels.MatchEqual, "a", false))
+
+	expr, err := parser.ParseExpr(`rate(up[5m])`)
+	if err != nil {
+		t.Fatalf("failed to parse query: %v", err)
+	}
+
+	enforced, err := enforcer.EnforceNode(expr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	call, ok := enforced.(*parser.Call)
+	if !ok {
+		t.Fatalf("expected a *parser.Call, got %T", enforced)
+	}
+	ms, ok := call.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		t.Fatalf("expected a *parser.MatrixSelector, got %T", call.Args[0])
+	}
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		t.Fatalf("expected a *parser.VectorSelector, got %T", ms.VectorSelector)
+	}
+
+	var found bool
+	for _, m := range vs.LabelMatchers {
+		if m.Name == "namespace" && m.Value == "a" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected an injected namespace=\"a\" matcher, got %v", vs.LabelMatchers)
+	}
+}
+
+// TestEnforceMatchParamExpandsOr verifies that EnforceMatchParam turns a
+// single match[] selector into one selector per DNF branch when the
+// Enforcer was built from an EnforcementExpr containing an "or".
+func TestEnforceMatchParamExpandsOr(t *testing.T) {
+	enforcer := NewEnforcerFromExpr(OrExpr(
+		MatchExpr("env", labels.MatchEqual, "prod", false),
+		MatchExpr("env", labels.MatchEqual, "stage", false),
+	))
+
+	got, err := enforcer.EnforceMatchParam([]string{`{__name__="up"}`})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 selectors, got %d: %v", len(got), got)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		`{__name__="up",env="prod"}`,
+		`{__name__="up",env="stage"}`,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// EnforceMatchParam enforces ms on a set of match[] selectors, as used by
+// the /api/v1/labels, /api/v1/label/<name>/values and /api/v1/series
+// endpoints. Without this, those endpoints only take series matchers as an
+// optional filter, so an unconstrained request would otherwise leak label
+// names/values across every enforced value.
+//
+// When values is empty, a single enforced-only selector is synthesized so
+// that an unfiltered request is still constrained. When ms was built from
+// an EnforcementExpr containing an "or", a single input selector can
+// expand into several output selectors, since match[] already treats
+// multiple values as a union.
+func (ms Enforcer) EnforceMatchParam(values []string) ([]string, error) {
+	if len(values) == 0 {
+		values = []string{"{}"}
+	}
+
+	var result []string
+	for _, v := range values {
+		matchers, err := parser.ParseMetricSelector(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse match[] parameter %q: %w", v, err)
+		}
+
+		branches, err := ms.enforceMatcherBranches(matchers)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, branch := range branches {
+			result = append(result, matchersToSelector(branch))
+		}
+	}
+
+	return result, nil
+}
+
+// enforceMatcherBranches enforces ms on targets, returning every matcher
+// set that satisfies it. With a flat Enforcer (NewEnforcer) this is always
+// a single set; with a boolean EnforcementExpr (NewEnforcerFromExpr) it is
+// one set per disjunct of the expression's disjunctive normal form.
+func (ms Enforcer) enforceMatcherBranches(targets []*labels.Matcher) ([][]*labels.Matcher, error) {
+	if ms.expr == nil {
+		merged, err := ms.EnforceMatchers(targets)
+		if err != nil {
+			return nil, err
+		}
+		return [][]*labels.Matcher{merged}, nil
+	}
+
+	branches, err := ms.expr.toDNF()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([][]*labels.Matcher, 0, len(branches))
+	for _, branch := range branches {
+		merged, err := mergeMatchers(append([]*labels.Matcher(nil), targets...), branch)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, merged)
+	}
+
+	return res, nil
+}
+
+// matchersToSelector renders matchers back into PromQL metric selector
+// syntax, e.g. `{namespace="a",pod=~"foo.*"}`. Matchers are sorted by name
+// so that the output is deterministic.
+func matchersToSelector(matchers []*labels.Matcher) string {
+	sorted := append([]*labels.Matcher(nil), matchers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	parts := make([]string, len(sorted))
+	for i, m := range sorted {
+		parts[i] = m.String()
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// fakeSeries stands in for the series a real Prometheus/Thanos upstream
+// would hold, for the /api/v1/label/<name>/values integration test below.
+var fakeSeries = []labels.Labels{
+	labels.FromStrings("__name__", "up", "namespace", "team-a", "pod", "a-1"),
+	labels.FromStrings("__name__", "up", "namespace", "team-a", "pod", "a-2"),
+	labels.FromStrings("__name__", "up", "namespace", "team-b", "pod", "b-1"),
+}
+
+// newFakeLabelValuesUpstream serves /api/v1/label/<name>/values the way
+// Prometheus does, filtering fakeSeries by every match[] query parameter
+// (series matching any one of them is included) exactly as the real
+// upstream would.
+func newFakeLabelValuesUpstream(t *testing.T, label string) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matchSets := r.URL.Query()["match[]"]
+
+		values := map[string]struct{}{}
+		for _, series := range fakeSeries {
+			if !seriesMatchesAny(t, series, matchSets) {
+				continue
+			}
+			if v := series.Get(label); v != "" {
+				values[v] = struct{}{}
+			}
+		}
+
+		sorted := make([]string, 0, len(values))
+		for v := range values {
+			sorted = append(sorted, v)
+		}
+		sort.Strings(sorted)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Status string   `json:"status"`
+			Data   []string `json:"data"`
+		}{Status: "success", Data: sorted})
+	}))
+}
+
+func seriesMatchesAny(t *testing.T, series labels.Labels, matchSets []string) bool {
+	t.Helper()
+
+	if len(matchSets) == 0 {
+		return true
+	}
+
+	for _, sel := range matchSets {
+		matchers, err := parser.ParseMetricSelector(sel)
+		if err != nil {
+			t.Fatalf("upstream received an unparseable match[] selector %q: %v", sel, err)
+		}
+
+		all := true
+		for _, m := range matchers {
+			if !m.Matches(series.Get(m.Name)) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TestEnforceMatchParamFiltersCrossTenantSeries is an integration test
+// confirming that label values from series outside the injected tenant
+// are filtered out of the upstream's response, covering both an
+// unfiltered request (no match[] at all) and one that already carries an
+// unrelated match[] selector.
+func TestEnforceMatchParamFiltersCrossTenantSeries(t *testing.T) {
+	enforcer := NewEnforcer(false, &labels.Matcher{
+		Type:  labels.MatchEqual,
+		Name:  "namespace",
+		Value: "team-a",
+	})
+
+	for _, tc := range []struct {
+		name   string
+		values []string
+	}{
+		{name: "no match[] parameter", values: nil},
+		{name: "pre-existing match[] parameter", values: []string{`{__name__="up"}`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enforced, err := enforcer.EnforceMatchParam(tc.values)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			upstream := newFakeLabelValuesUpstream(t, "pod")
+			defer upstream.Close()
+
+			q := url.Values{}
+			for _, sel := range enforced {
+				q.Add("match[]", sel)
+			}
+
+			resp, err := http.Get(upstream.URL + "?" + q.Encode())
+			if err != nil {
+				t.Fatalf("request to fake upstream failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var body struct {
+				Data []string `json:"data"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+
+			want := []string{"a-1", "a-2"}
+			if len(body.Data) != len(want) {
+				t.Fatalf("got pod values %v, want %v", body.Data, want)
+			}
+			for i := range want {
+				if body.Data[i] != want[i] {
+					t.Fatalf("got pod values %v, want %v", body.Data, want)
+				}
+			}
+		})
+	}
+}
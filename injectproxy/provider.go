@@ -0,0 +1,369 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// MatcherProvider supplies the label matchers to enforce for a single
+// request. Implementations typically read a value out of ctx (a header,
+// a JWT claim, ...) that an HTTP middleware placed there earlier in the
+// request's lifecycle.
+type MatcherProvider interface {
+	Matchers(ctx context.Context) ([]*labels.Matcher, error)
+}
+
+// CacheKeyer is an optional interface a MatcherProvider can implement to
+// give EnforcerFactory a cheap cache key for ctx, without doing the work
+// (building *labels.Matcher values, running a relabel regex, ...) that
+// Matchers does. ok is false when no value can be resolved from ctx (e.g.
+// a required header is absent); EnforcerFactory then skips its cache for
+// this request rather than caching under a misleading key.
+type CacheKeyer interface {
+	CacheKey(ctx context.Context) (key string, ok bool)
+}
+
+// StaticProvider is a MatcherProvider that always returns the same
+// matchers, regardless of ctx. It makes it possible to mix request-derived
+// and fixed matchers in the same EnforcerFactory.
+type StaticProvider struct {
+	matchers []*labels.Matcher
+	cacheKey string
+}
+
+// NewStaticProvider returns a StaticProvider always yielding ms.
+func NewStaticProvider(ms ...*labels.Matcher) *StaticProvider {
+	parts := make([]string, len(ms))
+	for i, m := range ms {
+		parts[i] = m.String()
+	}
+
+	return &StaticProvider{matchers: ms, cacheKey: strings.Join(parts, ",")}
+}
+
+func (p *StaticProvider) Matchers(_ context.Context) ([]*labels.Matcher, error) {
+	return p.matchers, nil
+}
+
+func (p *StaticProvider) CacheKey(_ context.Context) (string, bool) {
+	return p.cacheKey, true
+}
+
+type contextKey string
+
+const (
+	headerValuesContextKey contextKey = "injectproxy-header-values"
+	jwtClaimsContextKey    contextKey = "injectproxy-jwt-claims"
+)
+
+// ContextWithHeaderValues stashes the HTTP header values an HeaderProvider
+// will later read, keyed by (case-sensitive) header name. Middleware
+// extracting request headers should call this before invoking a handler
+// that uses an EnforcerFactory.
+func ContextWithHeaderValues(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headerValuesContextKey, headers)
+}
+
+// ContextWithJWTClaims stashes the decoded JWT claims a JWTClaimProvider
+// will later read. Middleware verifying the request's bearer token should
+// call this before invoking a handler that uses an EnforcerFactory.
+func ContextWithJWTClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, jwtClaimsContextKey, claims)
+}
+
+// HeaderProvider reads the enforcement value for its label out of the HTTP
+// header it was built with, as stashed by ContextWithHeaderValues.
+type HeaderProvider struct {
+	header  string
+	label   string
+	relabel *RelabelConfig
+}
+
+// NewHeaderProvider returns a HeaderProvider matching label against the
+// value of header. If relabel is non-nil, the header value is transformed
+// through it before being used as the matcher value.
+func NewHeaderProvider(header, label string, relabel *RelabelConfig) *HeaderProvider {
+	return &HeaderProvider{header: header, label: label, relabel: relabel}
+}
+
+func (p *HeaderProvider) Matchers(ctx context.Context) ([]*labels.Matcher, error) {
+	headers, _ := ctx.Value(headerValuesContextKey).(map[string]string)
+	value, ok := headers[p.header]
+	if !ok || value == "" {
+		return nil, fmt.Errorf("missing required header %q", p.header)
+	}
+
+	return applyProviderRelabel(p.relabel, p.label, p.header, value)
+}
+
+// CacheKey returns the raw header value, without building the matcher (or
+// running the relabel stage) Matchers would.
+func (p *HeaderProvider) CacheKey(ctx context.Context) (string, bool) {
+	headers, _ := ctx.Value(headerValuesContextKey).(map[string]string)
+	value, ok := headers[p.header]
+	if !ok || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+// JWTClaimProvider reads the enforcement value for its label out of a JWT
+// claim, as stashed by ContextWithJWTClaims. The claim path addresses
+// nested claims with a dot-separated path, e.g. "realm.tenant"; the path is
+// split on every ".", so a claim name that itself contains a dot cannot be
+// addressed.
+type JWTClaimProvider struct {
+	claimPath []string
+	label     string
+	relabel   *RelabelConfig
+}
+
+// NewJWTClaimProvider returns a JWTClaimProvider matching label against
+// the claim at claimPath. If relabel is non-nil, the claim value is
+// transformed through it before being used as the matcher value.
+func NewJWTClaimProvider(claimPath, label string, relabel *RelabelConfig) *JWTClaimProvider {
+	return &JWTClaimProvider{claimPath: strings.Split(claimPath, "."), label: label, relabel: relabel}
+}
+
+func (p *JWTClaimProvider) Matchers(ctx context.Context) ([]*labels.Matcher, error) {
+	claims, _ := ctx.Value(jwtClaimsContextKey).(map[string]interface{})
+
+	value, err := lookupClaim(claims, p.claimPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyProviderRelabel(p.relabel, p.label, strings.Join(p.claimPath, "."), value)
+}
+
+// CacheKey returns the raw claim value, without building the matcher (or
+// running the relabel stage) Matchers would.
+func (p *JWTClaimProvider) CacheKey(ctx context.Context) (string, bool) {
+	claims, _ := ctx.Value(jwtClaimsContextKey).(map[string]interface{})
+
+	value, err := lookupClaim(claims, p.claimPath)
+	if err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+func lookupClaim(claims map[string]interface{}, path []string) (string, error) {
+	var cur interface{} = claims
+	for i, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("jwt claim %q: %q is not an object", strings.Join(path, "."), strings.Join(path[:i], "."))
+		}
+		cur, ok = m[key]
+		if !ok {
+			return "", fmt.Errorf("jwt claim %q not found", strings.Join(path, "."))
+		}
+	}
+
+	value, ok := cur.(string)
+	if !ok {
+		return "", fmt.Errorf("jwt claim %q is not a string", strings.Join(path, "."))
+	}
+	return value, nil
+}
+
+// applyProviderRelabel builds the single matcher a MatcherProvider
+// returns. sourceKey/sourceValue are the raw value's name (a header or
+// claim path) and value; when relabel is configured, they are looked up
+// from it as a one-entry source_labels set.
+func applyProviderRelabel(relabel *RelabelConfig, label, sourceKey, sourceValue string) ([]*labels.Matcher, error) {
+	if relabel == nil {
+		m, err := labels.NewMatcher(labels.MatchEqual, label, sourceValue)
+		if err != nil {
+			return nil, err
+		}
+		return []*labels.Matcher{m}, nil
+	}
+
+	m, matched, err := relabel.Apply(map[string]string{sourceKey: sourceValue})
+	if err != nil {
+		return nil, err
+	}
+	if !matched {
+		return nil, fmt.Errorf("relabel rule did not match source value %q=%q", sourceKey, sourceValue)
+	}
+	return []*labels.Matcher{m}, nil
+}
+
+// RelabelConfig transforms a raw, request-derived value (a header, a JWT
+// claim, ...) into an enforcement matcher, the same way Prometheus's own
+// relabel_configs turn scraped metadata into labels: the values of
+// SourceLabels are joined with Separator, matched against Regex, and on a
+// match Replacement (which may reference capture groups as $1, $2, ...)
+// becomes the value of TargetLabel. This lets a raw claim like
+// "sub=team-a@corp" become "namespace=team-a" before injection.
+type RelabelConfig struct {
+	SourceLabels []string
+	Separator    string
+	Regex        *regexp.Regexp
+	Replacement  string
+	TargetLabel  string
+}
+
+// NewRelabelConfig compiles regex and returns the RelabelConfig described
+// by sourceLabels, separator, regex, replacement and targetLabel. An empty
+// separator defaults to ";", matching Prometheus's relabel_configs. An
+// empty replacement defaults to "$1".
+func NewRelabelConfig(sourceLabels []string, separator, regex, replacement, targetLabel string) (*RelabelConfig, error) {
+	if separator == "" {
+		separator = ";"
+	}
+	if replacement == "" {
+		replacement = "$1"
+	}
+
+	compiled, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid relabel regex: %w", err)
+	}
+
+	return &RelabelConfig{
+		SourceLabels: sourceLabels,
+		Separator:    separator,
+		Regex:        compiled,
+		Replacement:  replacement,
+		TargetLabel:  targetLabel,
+	}, nil
+}
+
+// Apply joins the values of rc.SourceLabels (looked up in values) and
+// matches them against rc.Regex. It returns matched == false when there is
+// no match, in which case no matcher should be injected.
+func (rc *RelabelConfig) Apply(values map[string]string) (matcher *labels.Matcher, matched bool, err error) {
+	parts := make([]string, len(rc.SourceLabels))
+	for i, sl := range rc.SourceLabels {
+		parts[i] = values[sl]
+	}
+	joined := strings.Join(parts, rc.Separator)
+
+	idx := rc.Regex.FindStringSubmatchIndex(joined)
+	if idx == nil {
+		return nil, false, nil
+	}
+
+	value := string(rc.Regex.ExpandString(nil, rc.Replacement, joined, idx))
+
+	m, err := labels.NewMatcher(labels.MatchEqual, rc.TargetLabel, value)
+	if err != nil {
+		return nil, false, err
+	}
+	return m, true, nil
+}
+
+// maxEnforcerCacheEntries bounds EnforcerFactory's cache so a long-running
+// proxy serving many tenants (or a JWTClaimProvider whose claim values
+// turn out to have more cardinality than expected) can't grow it
+// unbounded. There's no need for a full LRU here: once the bound is hit,
+// the whole cache is dropped and rebuilt from scratch, trading a burst of
+// cache misses for a far simpler implementation.
+const maxEnforcerCacheEntries = 4096
+
+// EnforcerFactory composes one or more MatcherProviders into an
+// Enforcer per request, so that callers no longer need to build a new
+// Enforcer by hand just to substitute a tenant value extracted from a
+// header or JWT claim.
+//
+// When every provider implements CacheKeyer, EnforcerForRequest caches
+// the resulting Enforcer keyed by those cheap, raw-value keys, so a
+// repeat request from the same tenant skips building *labels.Matcher
+// values, running any relabel stage, and allocating NewEnforcer's map
+// entirely (see BenchmarkEnforcerFactory_EnforcerForRequest). Providers
+// that don't implement CacheKeyer simply disable caching for that
+// request rather than risk keying on the wrong thing.
+type EnforcerFactory struct {
+	providers      []MatcherProvider
+	errorOnReplace bool
+
+	cache     atomic.Value // *sync.Map, string cache key -> *Enforcer
+	cacheSize int64        // atomic; approximate entry count of the current cache
+}
+
+// NewEnforcerFactory returns an EnforcerFactory combining providers, with
+// errorOnReplace passed through to every Enforcer it builds.
+func NewEnforcerFactory(errorOnReplace bool, providers ...MatcherProvider) *EnforcerFactory {
+	f := &EnforcerFactory{providers: providers, errorOnReplace: errorOnReplace}
+	f.cache.Store(&sync.Map{})
+	return f
+}
+
+// EnforcerForRequest resolves every provider's matchers for ctx and
+// returns the Enforcer that applies all of them, reusing a previously
+// built Enforcer when possible (see EnforcerFactory).
+func (f *EnforcerFactory) EnforcerForRequest(ctx context.Context) (*Enforcer, error) {
+	key, cacheable := f.cacheKey(ctx)
+
+	cache := f.cache.Load().(*sync.Map)
+	if cacheable {
+		if cached, ok := cache.Load(key); ok {
+			return cached.(*Enforcer), nil
+		}
+	}
+
+	var matchers []*labels.Matcher
+	for _, p := range f.providers {
+		ms, err := p.Matchers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, ms...)
+	}
+	enforcer := NewEnforcer(f.errorOnReplace, matchers...)
+
+	if !cacheable {
+		return enforcer, nil
+	}
+
+	actual, loaded := cache.LoadOrStore(key, enforcer)
+	if !loaded && atomic.AddInt64(&f.cacheSize, 1) > maxEnforcerCacheEntries {
+		f.cache.Store(&sync.Map{})
+		atomic.StoreInt64(&f.cacheSize, 0)
+	}
+	return actual.(*Enforcer), nil
+}
+
+// cacheKey returns the combined CacheKeyer key for every provider, and
+// false if any provider doesn't implement CacheKeyer or can't resolve a
+// key from ctx.
+func (f *EnforcerFactory) cacheKey(ctx context.Context) (string, bool) {
+	keyParts := make([]string, len(f.providers))
+
+	for i, p := range f.providers {
+		keyer, ok := p.(CacheKeyer)
+		if !ok {
+			return "", false
+		}
+
+		key, ok := keyer.CacheKey(ctx)
+		if !ok {
+			return "", false
+		}
+		keyParts[i] = key
+	}
+
+	return strings.Join(keyParts, "\x00"), true
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEnforcerFactoryCachesPerTenant(t *testing.T) {
+	factory := NewEnforcerFactory(false, NewHeaderProvider("X-Tenant", "namespace", nil))
+
+	ctxA := ContextWithHeaderValues(context.Background(), map[string]string{"X-Tenant": "team-a"})
+	ctxB := ContextWithHeaderValues(context.Background(), map[string]string{"X-Tenant": "team-b"})
+
+	a1, err := factory.EnforcerForRequest(ctxA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a2, err := factory.EnforcerForRequest(ctxA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a1 != a2 {
+		t.Fatal("expected the same Enforcer to be reused for the same tenant")
+	}
+
+	b1, err := factory.EnforcerForRequest(ctxB)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a1 == b1 {
+		t.Fatal("expected distinct Enforcers for distinct tenants")
+	}
+}
+
+// TestEnforcerFactoryBoundsCacheGrowth verifies that a long-running
+// EnforcerFactory seeing unbounded-cardinality tenant values doesn't grow
+// its cache without limit: once maxEnforcerCacheEntries is exceeded, the
+// whole cache is reset, so the map never holds more than one "generation"
+// worth of entries over maxEnforcerCacheEntries.
+func TestEnforcerFactoryBoundsCacheGrowth(t *testing.T) {
+	factory := NewEnforcerFactory(false, NewHeaderProvider("X-Tenant", "namespace", nil))
+
+	for i := 0; i < maxEnforcerCacheEntries*3; i++ {
+		ctx := ContextWithHeaderValues(context.Background(), map[string]string{
+			"X-Tenant": fmt.Sprintf("team-%d", i),
+		})
+		if _, err := factory.EnforcerForRequest(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	size := atomic.LoadInt64(&factory.cacheSize)
+	if size > maxEnforcerCacheEntries {
+		t.Fatalf("cache grew to %d entries, want at most %d", size, maxEnforcerCacheEntries)
+	}
+}
+
+// BenchmarkEnforcerFactory_EnforcerForRequest compares the cached
+// EnforcerFactory path against building a fresh Enforcer by hand on every
+// call, under both a single repeating tenant and many concurrent distinct
+// tenants, to justify whether the cache pays for itself under the
+// multi-tenant load prom-label-proxy actually serves.
+func BenchmarkEnforcerFactory_EnforcerForRequest(b *testing.B) {
+	const tenantCount = 64
+
+	tenantCtx := make([]context.Context, tenantCount)
+	for i := range tenantCtx {
+		tenantCtx[i] = ContextWithHeaderValues(context.Background(), map[string]string{
+			"X-Tenant": fmt.Sprintf("team-%d", i),
+		})
+	}
+
+	b.Run("cached/single-tenant", func(b *testing.B) {
+		factory := NewEnforcerFactory(false, NewHeaderProvider("X-Tenant", "namespace", nil))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := factory.EnforcerForRequest(tenantCtx[0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("cached/many-tenants", func(b *testing.B) {
+		factory := NewEnforcerFactory(false, NewHeaderProvider("X-Tenant", "namespace", nil))
+		b.ReportAllocs()
+		var i int
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ctx := tenantCtx[i%tenantCount]
+				i++
+				if _, err := factory.EnforcerForRequest(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("uncached/many-tenants", func(b *testing.B) {
+		provider := NewHeaderProvider("X-Tenant", "namespace", nil)
+		b.ReportAllocs()
+		var i int
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ctx := tenantCtx[i%tenantCount]
+				i++
+				matchers, err := provider.Matchers(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = NewEnforcer(false, matchers...)
+			}
+		})
+	})
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	amparse "github.com/prometheus/alertmanager/matchers/parse"
+	amlabels "github.com/prometheus/alertmanager/pkg/labels"
+)
+
+// SilenceMatcher is a single Alertmanager silence matcher, using the same
+// field names and semantics as Alertmanager's own API v2 model: IsRegex
+// distinguishes `=~`/`!~` from `=`/`!=`, and IsEqual distinguishes
+// `=`/`=~` from `!=`/`!~`.
+type SilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// op renders the Alertmanager matcher-grammar operator for m.
+func (m SilenceMatcher) op() string {
+	switch {
+	case m.IsRegex && m.IsEqual:
+		return "=~"
+	case m.IsRegex && !m.IsEqual:
+		return "!~"
+	case !m.IsRegex && m.IsEqual:
+		return "="
+	default:
+		return "!="
+	}
+}
+
+// String renders m back into Alertmanager matcher-grammar syntax, e.g.
+// `namespace=~"a|b"`.
+func (m SilenceMatcher) String() string {
+	return fmt.Sprintf("%s%s%s", m.Name, m.op(), strconv.Quote(m.Value))
+}
+
+// SilenceEnforcer enforces a set of SilenceMatchers on Alertmanager silence
+// payloads. Unlike Enforcer, it never converts a silence's matchers
+// through github.com/prometheus/prometheus/model/labels.Matcher: that type
+// round-trips some values lossily (e.g. ones containing commas or
+// backslashes) because its parser and String() method follow PromQL
+// selector syntax, not Alertmanager's own matcher grammar. SilenceEnforcer
+// instead reads and writes the Name/Value/IsRegex/IsEqual fields directly.
+type SilenceEnforcer struct {
+	labelMatchers  map[string]SilenceMatcher
+	errorOnReplace bool
+}
+
+// NewSilenceEnforcer mirrors NewEnforcer's constructor shape: ms are
+// AND'd, keyed uniquely by label name, and errorOnReplace controls whether
+// a conflicting existing matcher is rejected or replaced/preserved in the
+// same way as Enforcer.EnforceMatchers.
+func NewSilenceEnforcer(errorOnReplace bool, ms ...SilenceMatcher) *SilenceEnforcer {
+	entries := make(map[string]SilenceMatcher, len(ms))
+	for _, m := range ms {
+		entries[m.Name] = m
+	}
+
+	return &SilenceEnforcer{
+		labelMatchers:  entries,
+		errorOnReplace: errorOnReplace,
+	}
+}
+
+// ParseAMMatcher parses a single matcher using Alertmanager's own matcher
+// grammar (github.com/prometheus/alertmanager/matchers/parse), the same
+// parser amtool and the Alertmanager API use for silence matchers, so regex
+// anchoring, quoting and escaping all follow Alertmanager's own rules.
+// EnforceSilence does not call it: it works on the structured
+// Name/Value/IsRegex/IsEqual fields of the silence payload.
+func ParseAMMatcher(s string) (SilenceMatcher, error) {
+	m, err := amparse.Matcher(s)
+	if err != nil {
+		return SilenceMatcher{}, fmt.Errorf("invalid alertmanager matcher %q: %w", s, err)
+	}
+
+	return SilenceMatcher{
+		Name:    m.Name,
+		Value:   m.Value,
+		IsRegex: m.Type == amlabels.MatchRegexp || m.Type == amlabels.MatchNotRegexp,
+		IsEqual: m.Type == amlabels.MatchEqual || m.Type == amlabels.MatchRegexp,
+	}, nil
+}
+
+type illegalSilenceMatcherError struct {
+	msg string
+}
+
+func (e illegalSilenceMatcherError) Error() string { return e.msg }
+
+func newIllegalSilenceMatcherError(existing, replacement string) illegalSilenceMatcherError {
+	return illegalSilenceMatcherError{
+		msg: fmt.Sprintf("silence matcher (%s) conflicts with injected value (%s)", existing, replacement),
+	}
+}
+
+// EnforceMatchers applies the same precedence rules as
+// Enforcer.EnforceMatchers: if errorOnReplace is set, an existing matcher
+// for an enforced label that differs from the enforced one is rejected;
+// otherwise an enforced equality matcher replaces the existing matcher for
+// the same label, and any other collision keeps both.
+func (se SilenceEnforcer) EnforceMatchers(targets []SilenceMatcher) ([]SilenceMatcher, error) {
+	var res []SilenceMatcher
+
+	for _, target := range targets {
+		if enforced, ok := se.labelMatchers[target.Name]; ok {
+			if se.errorOnReplace && enforced.String() != target.String() {
+				return nil, newIllegalSilenceMatcherError(enforced.String(), target.String())
+			}
+
+			if !enforced.IsRegex && enforced.IsEqual {
+				continue
+			}
+		}
+
+		res = append(res, target)
+	}
+
+	for _, enforced := range se.labelMatchers {
+		res = append(res, enforced)
+	}
+
+	return res, nil
+}
+
+// EnforceSilence applies se to the "matchers" field of an Alertmanager
+// silence JSON payload, leaving every other field untouched, and returns
+// the re-serialized payload.
+func (se SilenceEnforcer) EnforceSilence(data []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal silence: %w", err)
+	}
+
+	var matchers []SilenceMatcher
+	if m, ok := raw["matchers"]; ok {
+		if err := json.Unmarshal(m, &matchers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal silence matchers: %w", err)
+		}
+	}
+
+	enforced, err := se.EnforceMatchers(matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	enforcedRaw, err := json.Marshal(enforced)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal enforced silence matchers: %w", err)
+	}
+	raw["matchers"] = enforcedRaw
+
+	return json.Marshal(raw)
+}
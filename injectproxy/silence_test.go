@@ -0,0 +1,158 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAMMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    SilenceMatcher
+		wantErr bool
+	}{
+		{
+			name:  "plain equality",
+			input: `namespace="team-a"`,
+			want:  SilenceMatcher{Name: "namespace", Value: "team-a", IsRegex: false, IsEqual: true},
+		},
+		{
+			name:  "negative equality",
+			input: `namespace!="team-a"`,
+			want:  SilenceMatcher{Name: "namespace", Value: "team-a", IsRegex: false, IsEqual: false},
+		},
+		{
+			name:  "anchored regex is preserved verbatim, not re-anchored",
+			input: `namespace=~"^team-(a|b)$"`,
+			want:  SilenceMatcher{Name: "namespace", Value: "^team-(a|b)$", IsRegex: true, IsEqual: true},
+		},
+		{
+			name:  "negative regex",
+			input: `namespace!~"team-.*"`,
+			want:  SilenceMatcher{Name: "namespace", Value: "team-.*", IsRegex: true, IsEqual: false},
+		},
+		{
+			name:  "comma in a quoted value is not treated as a separator",
+			input: `path="C:\\foo,bar"`,
+			want:  SilenceMatcher{Name: "path", Value: `C:\foo,bar`, IsRegex: false, IsEqual: true},
+		},
+		{
+			name:    "missing operator",
+			input:   `namespace"team-a"`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quote",
+			input:   `namespace="team-a`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseAMMatcher(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestEnforceSilencePreservesMatcherValues is a negative test for the bug
+// this SilenceEnforcer replaces: round-tripping a silence's matchers
+// through prometheus/model/labels.Matcher mangles values containing
+// commas or backslashes, because that type's String()/parser follow
+// PromQL selector syntax rather than Alertmanager's own grammar. Since
+// SilenceEnforcer only ever touches the structured Name/Value/IsRegex/
+// IsEqual fields, an unrelated matcher's value must survive unchanged.
+func TestEnforceSilencePreservesMatcherValues(t *testing.T) {
+	const input = `{
+		"id": "abc123",
+		"matchers": [
+			{"name": "path", "value": "C:\\foo,bar", "isRegex": false, "isEqual": true},
+			{"name": "alertname", "value": "^(Watchdog|Heartbeat)$", "isRegex": true, "isEqual": true}
+		],
+		"comment": "quarterly maintenance"
+	}`
+
+	se := NewSilenceEnforcer(false, SilenceMatcher{
+		Name:    "namespace",
+		Value:   "team-a",
+		IsRegex: false,
+		IsEqual: true,
+	})
+
+	out, err := se.EnforceSilence([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var result struct {
+		Matchers []SilenceMatcher `json:"matchers"`
+		Comment  string           `json:"comment"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %v", err)
+	}
+
+	if result.Comment != "quarterly maintenance" {
+		t.Fatalf("unrelated field was not preserved: got %q", result.Comment)
+	}
+
+	byName := make(map[string]SilenceMatcher, len(result.Matchers))
+	for _, m := range result.Matchers {
+		byName[m.Name] = m
+	}
+
+	if got := byName["path"]; got.Value != `C:\foo,bar` {
+		t.Fatalf("matcher value with comma/backslash was mangled: got %q", got.Value)
+	}
+	if got := byName["alertname"]; got.Value != "^(Watchdog|Heartbeat)$" {
+		t.Fatalf("anchored regex matcher value was mangled: got %q", got.Value)
+	}
+	if got := byName["namespace"]; got.Value != "team-a" {
+		t.Fatalf("enforced matcher was not injected: got %+v", got)
+	}
+}
+
+// TestEnforceSilenceRejectsConflict is a negative test for errorOnReplace:
+// a silence matcher that conflicts with the enforced value must be
+// rejected rather than silently replaced or widened.
+func TestEnforceSilenceRejectsConflict(t *testing.T) {
+	se := NewSilenceEnforcer(true, SilenceMatcher{
+		Name:    "namespace",
+		Value:   "team-a",
+		IsRegex: false,
+		IsEqual: true,
+	})
+
+	_, err := se.EnforceMatchers([]SilenceMatcher{
+		{Name: "namespace", Value: "team-b", IsRegex: false, IsEqual: true},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a conflicting matcher")
+	}
+}